@@ -11,13 +11,21 @@ package honeycomb
 
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	libhoney "github.com/honeycombio/libhoney-go"
 	"github.com/sirupsen/logrus"
@@ -37,10 +45,55 @@ import (
 // controlled variable.
 var autoflush = false
 
+// Honeycomb drops events with too many fields or too many bytes on the server
+// side, without telling the sender. We'd rather trim them here and mark them
+// as trimmed, so that at least some of the event arrives. Both limits can be
+// overridden by environment variable; 0 disables that check.
+var maxEventFields = 2000
+var maxEventBytes = 1000000
+
+// By default, the writer lets libhoney stamp each event with the time it was
+// sent. Setting HONEYCOMB_TIMESTAMP_KEYS to a comma-separated list of keys
+// makes it use the first of those keys present in the event as the event
+// time instead; HONEYCOMB_TIMESTAMP_REMOVE=1 also removes that key from the
+// event's fields, so the time isn't sent twice.
+var timestampKeys []string
+var removeTimestampKey = false
+
+// The cheapest events are the ones never sent. HONEYCOMB_MIN_LEVEL (e.g.
+// "error") drops anything less severe than that level, using logrus's level
+// names and ordering. It only ever drops: the logrus hook still sends just
+// its usual levels at or above the minimum. Events from the writer without a
+// recognizable level are still sent, unless HONEYCOMB_DROP_UNLEVELED=1.
+var minLevel = logrus.TraceLevel
+var hasMinLevel = false
+var dropUnleveled = false
+
 func init() {
 	if os.Getenv("HONEYCOMB_AUTOFLUSH") == "1" {
 		autoflush = true
 	}
+	if n, err := strconv.Atoi(os.Getenv("HONEYCOMB_MAX_FIELDS")); err == nil {
+		maxEventFields = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("HONEYCOMB_MAX_BYTES")); err == nil {
+		maxEventBytes = n
+	}
+	for _, k := range strings.Split(os.Getenv("HONEYCOMB_TIMESTAMP_KEYS"), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			timestampKeys = append(timestampKeys, k)
+		}
+	}
+	if os.Getenv("HONEYCOMB_TIMESTAMP_REMOVE") == "1" {
+		removeTimestampKey = true
+	}
+	if lvl, err := logrus.ParseLevel(os.Getenv("HONEYCOMB_MIN_LEVEL")); err == nil {
+		minLevel = lvl
+		hasMinLevel = true
+	}
+	if os.Getenv("HONEYCOMB_DROP_UNLEVELED") == "1" {
+		dropUnleveled = true
+	}
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -53,6 +106,10 @@ type HoneycombHook struct {
 }
 
 // Fire implements logrus.Hook
+//
+// Once Close has been called, entries are silently dropped: the hook is
+// still registered on the logger, and returning an error would make logrus
+// complain on stderr for every subsequent log line.
 func (hook *HoneycombHook) Fire(entry *logrus.Entry) error {
 	eventBuilder := libhoney.NewBuilder()
 	honeycombEvent := eventBuilder.NewEvent()
@@ -60,8 +117,9 @@ func (hook *HoneycombHook) Fire(entry *logrus.Entry) error {
 	const levelKey string = "level"
 	foundBin := false
 	foundLevel := false
+	fields := make(map[string]interface{}, len(entry.Data)+4)
 	for eachKey, eachValue := range entry.Data {
-		honeycombEvent.AddField(eachKey, eachValue)
+		fields[eachKey] = eachValue
 		switch eachKey {
 		case binKey:
 			foundBin = true
@@ -70,15 +128,24 @@ func (hook *HoneycombHook) Fire(entry *logrus.Entry) error {
 		}
 	}
 	if !foundLevel {
-		honeycombEvent.AddField("level", entry.Level.String())
+		fields["level"] = entry.Level.String()
 	}
 	if !foundBin {
-		honeycombEvent.AddField(binKey, filepath.Base(os.Args[0]))
+		fields[binKey] = filepath.Base(os.Args[0])
 	}
 	// Use cryptic values for these common fields, so there's
 	// less of a chance to conflict with any keys in entry.Data.
-	honeycombEvent.AddField("_ts", entry.Time)
-	honeycombEvent.AddField("_txt", entry.Message)
+	fields["_ts"] = entry.Time
+	fields["_txt"] = entry.Message
+	err := honeycombEvent.Add(limitEvent(fields, maxEventFields, maxEventBytes))
+	if err != nil {
+		return err
+	}
+	closeMu.RLock()
+	defer closeMu.RUnlock()
+	if closed {
+		return nil
+	}
 	honeycombEvent.Send()
 	if autoflush {
 		libhoney.Flush()
@@ -86,19 +153,87 @@ func (hook *HoneycombHook) Fire(entry *logrus.Entry) error {
 	return nil
 }
 
+// hookLevels are the levels the logrus hook sends.
+var hookLevels = []logrus.Level{
+	logrus.InfoLevel,
+	logrus.ErrorLevel,
+	logrus.FatalLevel,
+	logrus.PanicLevel,
+}
+
 // Levels implements logrus.Hook
+//
+// A minimum level only removes levels from hookLevels; it never adds any.
 func (hook *HoneycombHook) Levels() []logrus.Level {
-	return []logrus.Level{
-		logrus.InfoLevel,
-		logrus.ErrorLevel,
-		logrus.FatalLevel,
-		logrus.PanicLevel,
+	if !hasMinLevel {
+		return hookLevels
 	}
+	var levels []logrus.Level
+	for _, lvl := range hookLevels {
+		if lvl <= minLevel {
+			levels = append(levels, lvl)
+		}
+	}
+	return levels
 }
 
 // Flush ensures that all queued messages are dispatched immediately to Honeycomb.
 func (*HoneycombHook) Flush() {
-	libhoney.Flush()
+	closeMu.RLock()
+	defer closeMu.RUnlock()
+	if !closed {
+		libhoney.Flush()
+	}
+}
+
+// Close flushes all queued messages and shuts down the Honeycomb connection;
+// see the package-level Close.
+func (*HoneycombHook) Close(ctx context.Context) error {
+	return Close(ctx)
+}
+
+// closed is set by Close; libhoney can't be used once it's closed. Everything
+// which calls into libhoney holds closeMu's read lock from checking closed
+// until it's done, so that Close can't shut libhoney down in the middle of a
+// send, which would panic.
+var closeMu sync.RWMutex
+var closed = false
+
+// ErrClosed is returned by the writer for writes after Close.
+var ErrClosed = errors.New("honeycomb: write after Close")
+
+// Close dispatches all queued messages to Honeycomb and shuts down libhoney,
+// waiting until that is done or ctx expires, whichever is first. Call it on
+// shutdown so that events still in libhoney's batches aren't lost. If ctx
+// has already expired, libhoney is still shut down in the background, but
+// Close returns ctx.Err() immediately.
+//
+// Both the logrus hook and the writer share the one libhoney instance, so
+// after Close the hook drops its entries and the writer returns ErrClosed.
+// Calling Close more than once does nothing.
+func Close(ctx context.Context) error {
+	closeMu.Lock()
+	if closed {
+		closeMu.Unlock()
+		return nil
+	}
+	closed = true
+	done := make(chan struct{})
+	go func() {
+		libhoney.Close()
+		close(done)
+	}()
+	closeMu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // There are two things we should only do once -- one is initialize the libhoney library,
@@ -158,21 +293,39 @@ type honeycombWriter struct{}
 
 // Write implements io.Writer for honeycombWriter; it assumes that b is a JSON blob
 // and unmarshals it into an interface{}, then simply sends that as a new event
-// to honeycomb.
+// to honeycomb. If b isn't JSON but is a line from Tendermint's own logger,
+// that line's fields are sent instead.
 func (h *honeycombWriter) Write(b []byte) (int, error) {
-	var data map[string]interface{}
-	err := json.Unmarshal(b, &data)
+	data, err := unmarshalEvent(b)
 	if err != nil {
-		return 0, err
+		var ok bool
+		data, ok = parseTendermintLine(string(b))
+		if !ok {
+			return 0, err
+		}
+	}
+
+	if !levelAllowed(data, hasMinLevel, minLevel, dropUnleveled) {
+		return len(b), nil
 	}
 
 	data = expandFieldsIn(data, "_msg")
+	ts, hasTS := timestampIn(data, timestampKeys, removeTimestampKey)
+	data = limitEvent(data, maxEventFields, maxEventBytes)
 	evt := libhoney.NewBuilder().NewEvent()
+	if hasTS {
+		evt.Timestamp = ts
+	}
 	err = evt.Add(data)
 	if err != nil {
 		return 0, err
 	}
 
+	closeMu.RLock()
+	defer closeMu.RUnlock()
+	if closed {
+		return 0, ErrClosed
+	}
 	err = evt.Send()
 	if err != nil {
 		return 0, err
@@ -183,8 +336,54 @@ func (h *honeycombWriter) Write(b []byte) (int, error) {
 
 var _ io.Writer = (*honeycombWriter)(nil)
 
+// unmarshalEvent decodes a JSON object without losing numeric precision.
+// json.Unmarshal turns every number into a float64, which silently mangles
+// 64-bit IDs and nanosecond timestamps; instead, we keep integers which fit
+// as int64 and leave everything else as a json.Number, which marshals back
+// out verbatim.
+func unmarshalEvent(b []byte) (map[string]interface{}, error) {
+	var data map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	err := dec.Decode(&data)
+	if err != nil {
+		return nil, err
+	}
+	// json.Unmarshal rejects anything but whitespace after the object, and
+	// so do we.
+	off := dec.InputOffset()
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after top-level JSON object: %q", bytes.TrimSpace(b[off:]))
+	}
+	for k, v := range data {
+		data[k] = normalizeNumbers(v)
+	}
+	return data, nil
+}
+
+// normalizeNumbers converts json.Number values which fit in an int64,
+// descending into nested objects and arrays.
+func normalizeNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n
+		}
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = normalizeNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = normalizeNumbers(e)
+		}
+	}
+	return v
+}
+
 // NewWriter constructs a writer that assumes its input is JSON and
-// sends it to Honeycomb.
+// sends it to Honeycomb. Lines in Tendermint's key=value logger format
+// are also accepted.
 func NewWriter() (io.Writer, error) {
 	err := setup()
 	if err != nil {
@@ -193,18 +392,272 @@ func NewWriter() (io.Writer, error) {
 	return &honeycombWriter{}, nil
 }
 
+// levelAllowed reports whether an event should be sent given its "level"
+// field. When there is no minimum, everything is allowed. Events whose level
+// is missing or not a logrus level name are allowed unless dropUnleveled.
+func levelAllowed(data map[string]interface{}, hasMin bool, min logrus.Level, dropUnleveled bool) bool {
+	if !hasMin {
+		return true
+	}
+	s, ok := data["level"].(string)
+	if !ok {
+		return !dropUnleveled
+	}
+	lvl, err := logrus.ParseLevel(s)
+	if err != nil {
+		return !dropUnleveled
+	}
+	return lvl <= min
+}
+
+// timestampIn returns the time stored under the first of keys present in
+// data which holds a recognizable time, optionally deleting that key.
+//
+// Strings are parsed as RFC3339. Numbers are taken as a Unix epoch; since
+// producers disagree about its unit, values too large to be seconds are
+// treated as milliseconds, microseconds, or nanoseconds by magnitude.
+func timestampIn(data map[string]interface{}, keys []string, remove bool) (time.Time, bool) {
+	for _, k := range keys {
+		v, ok := data[k]
+		if !ok {
+			continue
+		}
+		var ts time.Time
+		var err error
+		ok = true
+		switch t := v.(type) {
+		case time.Time:
+			ts = t
+		case string:
+			ts, err = time.Parse(time.RFC3339Nano, t)
+		case json.Number:
+			var n int64
+			if n, err = t.Int64(); err == nil {
+				ts, ok = epochTime(n)
+			} else {
+				var f float64
+				f, err = t.Float64()
+				ts, ok = epochSecondsTime(f)
+			}
+		case int64:
+			ts, ok = epochTime(t)
+		case int:
+			ts, ok = epochTime(int64(t))
+		case float64:
+			ts, ok = epochSecondsTime(t)
+		default:
+			continue
+		}
+		if err != nil || !ok {
+			continue
+		}
+		if remove {
+			delete(data, k)
+		}
+		return ts, true
+	}
+	return time.Time{}, false
+}
+
+// epochTime converts an integer Unix epoch in s, ms, us, or ns to a time.Time.
+// Negative epochs aren't recognized, and the second return value is false.
+func epochTime(n int64) (time.Time, bool) {
+	switch {
+	case n < 0:
+		return time.Time{}, false
+	case n > 1e17:
+		return time.Unix(n/1e9, n%1e9), true
+	case n > 1e14:
+		return time.Unix(n/1e6, n%1e6*1e3), true
+	case n > 1e11:
+		return time.Unix(n/1e3, n%1e3*1e6), true
+	}
+	return time.Unix(n, 0), true
+}
+
+// epochSecondsTime converts a fractional Unix epoch to a time.Time. Values
+// too large to be seconds are truncated and handled like epochTime; values
+// which don't fit in an int64, and NaN, aren't recognized.
+func epochSecondsTime(f float64) (time.Time, bool) {
+	if math.IsNaN(f) || f < 0 || f >= math.MaxInt64 {
+		return time.Time{}, false
+	}
+	if f > 1e11 {
+		return epochTime(int64(f))
+	}
+	sec := math.Floor(f)
+	return time.Unix(int64(sec), int64(math.Round((f-sec)*1e9))), true
+}
+
+// These keys are added by limitEvent when it has to cut an event down to size.
+const overflowKey = "_overflow"
+const trimmedKey = "_event_trimmed"
+
+// minEventFields is the smallest field limit limitEvent will enforce.
+const minEventFields = 3
+
+// limitEvent enforces the field count and byte size limits on data.
+//
+// When there are more than maxFields fields, the fields past the limit in
+// sorted key order are moved into a single nested object under _overflow.
+// Any existing _overflow or _event_trimmed field is moved there too.
+// When the serialized event is larger than maxBytes, the largest fields are
+// dropped until it fits, since that loses the fewest keys. Either way, the
+// event is marked with _event_trimmed: true. A limit <= 0 is not enforced.
+//
+// A trimmed event needs room for _overflow, _event_trimmed, and at least one
+// of its own fields, so a maxFields below 3 is treated as 3.
+func limitEvent(data map[string]interface{}, maxFields, maxBytes int) map[string]interface{} {
+	if maxFields > 0 && maxFields < minEventFields {
+		maxFields = minEventFields
+	}
+	if maxFields > 0 && len(data) > maxFields {
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		// leave room for the overflow object and the trimmed marker
+		keep := maxFields - 2
+		overflow := make(map[string]interface{}, len(keys)-keep)
+		kept := 0
+		for _, k := range keys {
+			// fields which already use our keys always overflow, rather
+			// than being overwritten
+			if kept < keep && k != overflowKey && k != trimmedKey {
+				kept++
+				continue
+			}
+			overflow[k] = data[k]
+			delete(data, k)
+		}
+		data[overflowKey] = overflow
+		data[trimmedKey] = true
+	}
+
+	if maxBytes > 0 {
+		// Most events are small, so avoid encoding every one of them twice
+		// when a cheap estimate already shows that this one fits.
+		if n, ok := sizeUpperBound(data); ok && n <= maxBytes {
+			return data
+		}
+		b, err := json.Marshal(data)
+		if err != nil || len(b) <= maxBytes {
+			return data
+		}
+		size := len(b)
+		if _, ok := data[trimmedKey]; !ok {
+			data[trimmedKey] = true
+			size += len(`,"` + trimmedKey + `":true`)
+		}
+
+		type field struct {
+			key  string
+			size int
+		}
+		fields := make([]field, 0, len(data))
+		for k, v := range data {
+			if k == trimmedKey {
+				continue
+			}
+			vb, err := json.Marshal(v)
+			if err != nil {
+				continue
+			}
+			// quotes around the key, the colon, and the separating comma
+			fields = append(fields, field{k, len(k) + len(vb) + 4})
+		}
+		sort.Slice(fields, func(i, j int) bool {
+			if fields[i].size == fields[j].size {
+				return fields[i].key < fields[j].key
+			}
+			return fields[i].size > fields[j].size
+		})
+		for _, f := range fields {
+			if size <= maxBytes {
+				break
+			}
+			delete(data, f.key)
+			size -= f.size
+		}
+	}
+	return data
+}
+
+// sizeUpperBound returns a number of bytes which the JSON encoding of data
+// can't exceed, without encoding it. It only knows about flat values of the
+// common scalar types; for anything else, the second return value is false.
+func sizeUpperBound(data map[string]interface{}) (int, bool) {
+	// a string is quoted, and each byte escapes to at most \u00XX
+	str := func(s string) int { return 6*len(s) + 2 }
+	n := 2 // braces
+	for k, v := range data {
+		n += str(k) + 2 // colon and comma
+		switch t := v.(type) {
+		case string:
+			n += str(t)
+		case json.Number:
+			n += len(t)
+		case bool, nil:
+			n += 5
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+			n += 20
+		case float32, float64:
+			n += 24
+		case time.Time:
+			n += len(`"2006-01-02T15:04:05.999999999-07:00"`)
+		default:
+			return 0, false
+		}
+	}
+	return n, true
+}
+
+// These are compiled once and shared: a *regexp.Regexp is safe for
+// concurrent use, so expandFieldsIn has no mutable package-level state and
+// may be called from many goroutines, as long as each passes its own map.
+var (
+	// pattern for matching lines that have key: value
+	expandLinePat = regexp.MustCompile(`^([A-Z][A-Za-z0-9]+):[ \t]*(.*[^{])$`)
+	// pattern for splitting up lines
+	expandSplitPat = regexp.MustCompile(`[ \t]*\n[ \t]*`)
+	// patterns for the lines which open and close a section, like Header{
+	// and }#<hash>; some sections close with a bare } instead
+	expandOpenPat  = regexp.MustCompile(`^([A-Z][A-Za-z0-9]*)\{$`)
+	expandClosePat = regexp.MustCompile(`^\}(?:#([0-9A-Fa-f]*))?$`)
+	// pattern for finding the word boundaries in a section name
+	expandWordPat = regexp.MustCompile(`([a-z0-9])([A-Z])`)
+)
+
 // Tendermint seems to shove a blob of badly-formatted data into _msg, so we
 // check for that case and try to extract key/value pairs from it.
 // But not everything matches that way so we also keep _msg around
+//
+// Sections of the dump end with their hash, as in }#<hash>; those are kept
+// as <section>_hash, e.g. header_hash or block_hash. Sections with an empty
+// hash, or closed by a bare }, are skipped.
 func expandFieldsIn(data map[string]interface{}, field string) map[string]interface{} {
 	if m, ok := data[field]; ok {
-		// pattern for matching lines that have key: value
-		lpat := regexp.MustCompile(`^([A-Z][A-Za-z0-9]+):[ \t]*(.*[^{])$`)
-		// pattern for splitting up lines
-		spat := regexp.MustCompile(`[ \t]*\n[ \t]*`)
-		ss := spat.Split(m.(string), -1)
+		ss := expandSplitPat.Split(m.(string), -1)
+		var sections []string
 		for _, s := range ss {
-			r := lpat.FindStringSubmatch(s)
+			if r := expandOpenPat.FindStringSubmatch(s); r != nil {
+				sections = append(sections, r[1])
+				continue
+			}
+			if r := expandClosePat.FindStringSubmatch(s); r != nil {
+				if len(sections) == 0 {
+					continue
+				}
+				section := sections[len(sections)-1]
+				sections = sections[:len(sections)-1]
+				if r[1] != "" {
+					key := strings.ToLower(expandWordPat.ReplaceAllString(section, "${1}_${2}")) + "_hash"
+					data[key] = r[1]
+				}
+				continue
+			}
+			r := expandLinePat.FindStringSubmatch(s)
 			if r != nil {
 				n, err := strconv.Atoi(r[2])
 				if err != nil {
@@ -217,3 +670,114 @@ func expandFieldsIn(data map[string]interface{}, field string) map[string]interf
 	}
 	return data
 }
+
+// Tendermint's line-oriented logger writes lines like
+//
+//	I[2019-02-07|23:01:59.268] Executed block        module=state height=54 validTxs=0
+//
+// with a one-letter level, a bracketed timestamp, a padded message, and then
+// key=value pairs whose values are quoted when they contain spaces. The
+// timestamp is the logging host's local time, without a zone.
+var tmLinePat = regexp.MustCompile(`^([DIWEN])\[(\d{4}-\d{2}-\d{2}\|\d{2}:\d{2}:\d{2}\.\d{3})\] ?(.*)$`)
+var tmKeyPat = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_.\-]*)=(.*)$`)
+
+// Only plain decimals are converted to numbers: ParseFloat would also take
+// inf and NaN, which can't be sent as JSON, and turn hex like 12E4 into 120000.
+// Values with a leading zero, like 007, are IDs rather than numbers.
+var tmNumberPat = regexp.MustCompile(`^-?(0|[1-9]\d*)(\.\d+)?$`)
+
+const tmTimeLayout = "2006-01-02|15:04:05.000"
+
+var tmLevels = map[string]string{
+	"D": "debug",
+	"I": "info",
+	"W": "warning",
+	"E": "error",
+	"N": "none",
+}
+
+// parseTendermintLine extracts the level, timestamp, message and key=value
+// pairs from a Tendermint log line. The timestamp and message go in _ts and
+// _txt, matching the logrus hook: they always win over pairs of the same
+// name, while a level pair wins over the line's level letter. Decimal values
+// are converted to numbers of the same types unmarshalEvent produces: int64
+// when they fit, otherwise json.Number.
+// The timestamp is read as local time, since that's how Tendermint writes it;
+// this assumes the log is parsed on a host in the same zone as the logger.
+// The second return value is false when s isn't in that format.
+func parseTendermintLine(s string) (map[string]interface{}, bool) {
+	r := tmLinePat.FindStringSubmatch(strings.TrimRight(s, "\r\n"))
+	if r == nil {
+		return nil, false
+	}
+	ts, err := time.ParseInLocation(tmTimeLayout, r[2], time.Local)
+	if err != nil {
+		return nil, false
+	}
+	// The message can itself contain '=', so the key=value section is the
+	// longest run of tokens at the end of the line which all parse as pairs.
+	rest := r[3]
+	tokens, starts := splitTendermintTokens(rest)
+	msgEnd := len(rest)
+	pairs := make(map[string]interface{})
+	for i := len(tokens) - 1; i >= 0; i-- {
+		kv := tmKeyPat.FindStringSubmatch(tokens[i])
+		if kv == nil {
+			break
+		}
+		v := kv[2]
+		if strings.HasPrefix(v, `"`) {
+			v, err = strconv.Unquote(v)
+			if err != nil {
+				break
+			}
+			pairs[kv[1]] = v
+		} else if !tmNumberPat.MatchString(v) {
+			pairs[kv[1]] = v
+		} else if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			pairs[kv[1]] = n
+		} else {
+			pairs[kv[1]] = json.Number(v)
+		}
+		msgEnd = starts[i]
+	}
+
+	data := pairs
+	if _, ok := data["level"]; !ok {
+		data["level"] = tmLevels[r[1]]
+	}
+	data["_ts"] = ts
+	data["_txt"] = strings.TrimSpace(rest[:msgEnd])
+	return data, true
+}
+
+// splitTendermintTokens splits s on spaces, except within double-quoted
+// values, and returns each token along with its starting offset in s.
+func splitTendermintTokens(s string) ([]string, []int) {
+	var tokens []string
+	var starts []int
+	i := 0
+	for i < len(s) {
+		if s[i] == ' ' {
+			i++
+			continue
+		}
+		start := i
+		quoted := false
+		for i < len(s) && (quoted || s[i] != ' ') {
+			switch {
+			case quoted && s[i] == '\\':
+				i++
+			case s[i] == '"':
+				quoted = !quoted
+			}
+			i++
+		}
+		if i > len(s) {
+			i = len(s)
+		}
+		tokens = append(tokens, s[start:i])
+		starts = append(starts, start)
+	}
+	return tokens, starts
+}
@@ -11,8 +11,18 @@ package honeycomb
 
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	libhoney "github.com/honeycombio/libhoney-go"
+	"github.com/honeycombio/libhoney-go/transmission"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -63,3 +73,449 @@ func TestReal1(t *testing.T) {
 	assert.Equal(t, result["LastCommit"], "FC9BAB94965F7C00A896AF484610B7869973E7D06E537274407F70359B353E7A")
 	assert.Equal(t, result["BlockID"], "8D5BF9FB560629C5A769FC0B81E8344CCCF09D3BE910D8AB6F04365DA0170692:1:FB253C748504")
 }
+
+func TestUnmarshalEventPrecision(t *testing.T) {
+	data, err := unmarshalEvent([]byte(`{"id":9007199254740993,"ts":1581036119268908973,"n":3,"f":12.5,"huge":123456789012345678901234567890,"nested":{"id":9007199254740993}}` + "\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(9007199254740993), data["id"])
+	assert.Equal(t, int64(1581036119268908973), data["ts"])
+	assert.Equal(t, int64(3), data["n"])
+	assert.Equal(t, json.Number("12.5"), data["f"])
+	assert.Equal(t, json.Number("123456789012345678901234567890"), data["huge"])
+	assert.Equal(t, int64(9007199254740993), data["nested"].(map[string]interface{})["id"])
+
+	_, err = unmarshalEvent([]byte(`{"a":1} {"b":2}`))
+	assert.Error(t, err)
+	_, err = unmarshalEvent([]byte(`{"a":1} }`))
+	assert.EqualError(t, err, `unexpected data after top-level JSON object: "}"`)
+	_, err = unmarshalEvent([]byte(`{"a":1}]`))
+	assert.Error(t, err)
+	_, err = unmarshalEvent([]byte(`not json`))
+	assert.Error(t, err)
+}
+
+func TestLimitEventFields(t *testing.T) {
+	data := make(map[string]interface{})
+	for i := 0; i < 1000; i++ {
+		data[fmt.Sprintf("field%04d", i)] = i
+	}
+
+	result := limitEvent(data, 100, 0)
+	assert.Len(t, result, 100)
+	assert.Equal(t, true, result[trimmedKey])
+	assert.Equal(t, 0, result["field0000"])
+	assert.Equal(t, 97, result["field0097"])
+	assert.NotContains(t, result, "field0098")
+	overflow := result[overflowKey].(map[string]interface{})
+	assert.Len(t, overflow, 902)
+	assert.Equal(t, 999, overflow["field0999"])
+}
+
+func TestLimitEventBytes(t *testing.T) {
+	data := make(map[string]interface{})
+	for i := 0; i < 1000; i++ {
+		data[fmt.Sprintf("field%04d", i)] = i
+	}
+	data["big"] = strings.Repeat("x", 10000)
+
+	result := limitEvent(data, 0, 20000)
+	assert.NotContains(t, result, "big")
+	assert.Equal(t, true, result[trimmedKey])
+	assert.Equal(t, 999, result["field0999"])
+	b, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.True(t, len(b) <= 20000)
+}
+
+func TestLimitEventExistingOverflowKey(t *testing.T) {
+	data := map[string]interface{}{"_overflow": "user", "_event_trimmed": "also user", "a": 1, "b": 2, "c": 3}
+	result := limitEvent(data, 4, 0)
+	assert.Len(t, result, 4)
+	assert.Equal(t, 1, result["a"])
+	assert.Equal(t, 2, result["b"])
+	assert.Equal(t, true, result[trimmedKey])
+	assert.Equal(t, map[string]interface{}{
+		"_overflow":      "user",
+		"_event_trimmed": "also user",
+		"c":              3,
+	}, result[overflowKey])
+}
+
+func TestLimitEventTinyFieldLimit(t *testing.T) {
+	for _, max := range []int{1, 2, 3} {
+		data := map[string]interface{}{"a": 1, "b": 2, "c": 3, "d": 4}
+		result := limitEvent(data, max, 0)
+		assert.Len(t, result, 3, "max %d", max)
+		assert.Equal(t, 1, result["a"])
+		assert.Equal(t, true, result[trimmedKey])
+		assert.Len(t, result[overflowKey], 3)
+	}
+}
+
+func TestSizeUpperBound(t *testing.T) {
+	data := map[string]interface{}{
+		"s":    "quote\" and \u0001 and <html> and ünïcode",
+		"i":    int64(-9223372036854775808),
+		"u":    uint64(18446744073709551615),
+		"f":    -1.2345678901234567e-308,
+		"b":    false,
+		"n":    nil,
+		"num":  json.Number("123.456"),
+		"ts":   time.Date(2020, 4, 19, 15, 18, 28, 565000001, time.FixedZone("x", -7*3600)),
+		"\x01": "key needing escapes",
+	}
+	n, ok := sizeUpperBound(data)
+	assert.True(t, ok)
+	b, err := json.Marshal(data)
+	assert.NoError(t, err)
+	assert.True(t, len(b) <= n, "%d > %d", len(b), n)
+
+	_, ok = sizeUpperBound(map[string]interface{}{"m": map[string]interface{}{}})
+	assert.False(t, ok)
+}
+
+func TestLimitEventUnderLimits(t *testing.T) {
+	data := map[string]interface{}{"a": 1, "b": "two"}
+	result := limitEvent(data, 10, 1000)
+	assert.Equal(t, map[string]interface{}{"a": 1, "b": "two"}, result)
+}
+
+func TestParseTendermintLine(t *testing.T) {
+	data, ok := parseTendermintLine(`I[2021-01-01|15:18:28.565] Committed state                              module=state height=23449 txs=0 appHash=4A1B fee=1.5 err="lost a = sign"` + "\n")
+	assert.True(t, ok)
+	assert.Equal(t, "info", data["level"])
+	assert.Equal(t, time.Date(2021, 1, 1, 15, 18, 28, 565000000, time.Local), data["_ts"])
+	assert.Equal(t, "Committed state", data["_txt"])
+	assert.Equal(t, "state", data["module"])
+	assert.Equal(t, int64(23449), data["height"])
+	assert.Equal(t, int64(0), data["txs"])
+	assert.Equal(t, "4A1B", data["appHash"])
+	assert.Equal(t, json.Number("1.5"), data["fee"])
+	assert.Equal(t, "lost a = sign", data["err"])
+}
+
+func TestParseTendermintLineMessageWithEquals(t *testing.T) {
+	data, ok := parseTendermintLine(`E[2021-01-01|15:18:28.565] failed: a=b is not allowed here module=p2p`)
+	assert.True(t, ok)
+	assert.Equal(t, "error", data["level"])
+	assert.Equal(t, "failed: a=b is not allowed here", data["_txt"])
+	assert.Equal(t, "p2p", data["module"])
+	assert.NotContains(t, data, "a")
+}
+
+func TestParseTendermintLineNonDecimal(t *testing.T) {
+	data, ok := parseTendermintLine(`N[2021-01-01|15:18:28.565] odd values x=inf y=NaN hash=12E4 neg=-3 plus=+3`)
+	assert.True(t, ok)
+	assert.Equal(t, "none", data["level"])
+	assert.Equal(t, "inf", data["x"])
+	assert.Equal(t, "NaN", data["y"])
+	assert.Equal(t, "12E4", data["hash"])
+	assert.Equal(t, int64(-3), data["neg"])
+	assert.Equal(t, "+3", data["plus"])
+	_, err := json.Marshal(data)
+	assert.NoError(t, err)
+}
+
+func TestParseTendermintLineNumbers(t *testing.T) {
+	data, ok := parseTendermintLine(`I[2021-01-01|15:18:28.565] numbers big=18446744073709551615 id=007 h=0123 zero=0 frac=0.25 max=9223372036854775807`)
+	assert.True(t, ok)
+	assert.Equal(t, json.Number("18446744073709551615"), data["big"])
+	assert.Equal(t, "007", data["id"])
+	assert.Equal(t, "0123", data["h"])
+	assert.Equal(t, int64(0), data["zero"])
+	assert.Equal(t, json.Number("0.25"), data["frac"])
+	assert.Equal(t, int64(9223372036854775807), data["max"])
+}
+
+func TestParseTendermintLineReservedKeys(t *testing.T) {
+	data, ok := parseTendermintLine(`E[2021-01-01|15:18:28.565] x _ts=foo _txt=bar level=fatal`)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2021, 1, 1, 15, 18, 28, 565000000, time.Local), data["_ts"])
+	assert.Equal(t, "x", data["_txt"])
+	assert.Equal(t, "fatal", data["level"])
+
+	data, ok = parseTendermintLine(`E[2021-01-01|15:18:28.565] x module=p2p`)
+	assert.True(t, ok)
+	assert.Equal(t, "error", data["level"])
+}
+
+func TestParseTendermintLineNoMatch(t *testing.T) {
+	_, ok := parseTendermintLine(`{"level":"info"}`)
+	assert.False(t, ok)
+	_, ok = parseTendermintLine(`just some text`)
+	assert.False(t, ok)
+}
+
+func TestTimestampIn(t *testing.T) {
+	want := time.Date(2020, 4, 19, 15, 18, 28, 565000000, time.UTC)
+	keys := []string{"timestamp", "ts", "time"}
+
+	data := map[string]interface{}{"ts": "2020-04-19T15:18:28.565Z", "time": "ignored"}
+	ts, ok := timestampIn(data, keys, false)
+	assert.True(t, ok)
+	assert.True(t, want.Equal(ts))
+	assert.Contains(t, data, "ts")
+
+	data = map[string]interface{}{"time": "not a time", "timestamp": "also not", "ts": json.Number("1587309508.565")}
+	ts, ok = timestampIn(data, keys, true)
+	assert.True(t, ok)
+	assert.Equal(t, want.UnixNano()/1e6, ts.UnixNano()/1e6)
+	assert.NotContains(t, data, "ts")
+	assert.Contains(t, data, "time")
+
+	for _, n := range []int64{1587309508565, 1587309508565000, 1587309508565000000} {
+		ts, ok = timestampIn(map[string]interface{}{"time": n}, keys, false)
+		assert.True(t, ok)
+		assert.True(t, want.Equal(ts), "epoch %d", n)
+	}
+
+	// large microsecond epochs used to overflow into the 1600s
+	ts, ok = timestampIn(map[string]interface{}{"time": int64(9300000000000000)}, keys, false)
+	assert.True(t, ok)
+	assert.True(t, time.Unix(9300000000, 0).Equal(ts))
+
+	// out of range epochs fall through to the next key
+	for _, bad := range []interface{}{json.Number("1e300"), json.Number("-5"), 1e300, math.NaN(), math.Inf(1), int64(-1)} {
+		data = map[string]interface{}{"timestamp": bad, "ts": "2020-04-19T15:18:28.565Z"}
+		ts, ok = timestampIn(data, keys, true)
+		assert.True(t, ok)
+		assert.True(t, want.Equal(ts), "epoch %v", bad)
+		assert.Contains(t, data, "timestamp")
+	}
+
+	_, ok = timestampIn(map[string]interface{}{"msg": "hi"}, keys, false)
+	assert.False(t, ok)
+	_, ok = timestampIn(map[string]interface{}{"time": "hi"}, nil, false)
+	assert.False(t, ok)
+}
+
+// sampleBlock is a Tendermint block dump, as it appears in _msg.
+const sampleBlock = `Block{
+  Header{
+    Version:        {9 0}
+    ChainID:        test-chain-OuwpVw
+    Height:         54
+    Time:           2019-02-07 23:01:59.268908973 +0000 UTC
+    NumTxs:         0
+    TotalTxs:       32
+    LastBlockID:    8D5BF9FB560629C5A769FC0B81E8344CCCF09D3BE910D8AB6F04365DA0170692:1:FB253C748504
+    LastCommit:     FC9BAB94965F7C00A896AF484610B7869973E7D06E537274407F70359B353E7A
+    Data:
+    Validators:     E3E0F4F720C407CE1D4BF9247F7894637E446EB66DE8ED6007B377D0D37C3DC4
+    NextValidators: E3E0F4F720C407CE1D4BF9247F7894637E446EB66DE8ED6007B377D0D37C3DC4
+    App:            EA0E1107DE0E660B17134C622CA1EE2130C74D1D
+    Consensus:       048091BC7DDC283F77BFBF91D73C44DA58C3DF8A9CBC867405D8B7F3DAADA22F
+    Results:        6E340B9CFFB37A989CA544E6BB780A2C78901D3FB33738768511A30617AFA01D
+    Evidence:
+    Proposer:       B349357FA7F27B7086029D9BB190FFEAE0642974
+  }#338B7D2D130B01C7A40EB5A36D5E55F7F99AED066F3E8AF8EA77777CE9C9F9D9
+  Data{
+
+  }#
+  EvidenceData{
+
+  }#
+  Commit{
+    BlockID:    8D5BF9FB560629C5A769FC0B81E8344CCCF09D3BE910D8AB6F04365DA0170692:1:FB253C748504
+    Precommits:
+      Vote{0:96B8EFE99E02 53/00/2(Precommit) 8D5BF9FB5606 141F776838A3 @ 2019-02-07T23:01:59.268908973Z}
+      Vote{1:B349357FA7F2 53/00/2(Precommit) 8D5BF9FB5606 B294DFE03F69 @ 2019-02-07T23:01:59.268908973Z}
+  }#FC9BAB94965F7C00A896AF484610B7869973E7D06E537274407F70359B353E7A
+}#338B7D2D130B01C7A40EB5A36D5E55F7F99AED066F3E8AF8EA77777CE9C9F9D9`
+
+func TestExpandFieldsInConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				result := expandFieldsIn(map[string]interface{}{"_msg": sampleBlock}, "_msg")
+				assert.Equal(t, 54, result["Height"])
+				assert.Equal(t, "test-chain-OuwpVw", result["ChainID"])
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestLevelAllowed(t *testing.T) {
+	lvl := func(s string) map[string]interface{} {
+		return map[string]interface{}{"level": s}
+	}
+	assert.True(t, levelAllowed(lvl("debug"), false, logrus.InfoLevel, true))
+	assert.False(t, levelAllowed(lvl("debug"), true, logrus.InfoLevel, false))
+	assert.False(t, levelAllowed(lvl("trace"), true, logrus.InfoLevel, false))
+	assert.True(t, levelAllowed(lvl("info"), true, logrus.InfoLevel, false))
+	assert.True(t, levelAllowed(lvl("WARNING"), true, logrus.InfoLevel, false))
+	assert.True(t, levelAllowed(lvl("error"), true, logrus.InfoLevel, false))
+
+	assert.True(t, levelAllowed(lvl("loud"), true, logrus.InfoLevel, false))
+	assert.False(t, levelAllowed(lvl("loud"), true, logrus.InfoLevel, true))
+	assert.True(t, levelAllowed(map[string]interface{}{}, true, logrus.InfoLevel, false))
+	assert.False(t, levelAllowed(map[string]interface{}{}, true, logrus.InfoLevel, true))
+	assert.True(t, levelAllowed(map[string]interface{}{"level": 3}, true, logrus.InfoLevel, false))
+}
+
+func TestSectionHashes(t *testing.T) {
+	data := map[string]interface{}{"_msg": sampleBlock}
+
+	result := expandFieldsIn(data, "_msg")
+	assert.Equal(t, "338B7D2D130B01C7A40EB5A36D5E55F7F99AED066F3E8AF8EA77777CE9C9F9D9", result["block_hash"])
+	assert.Equal(t, "338B7D2D130B01C7A40EB5A36D5E55F7F99AED066F3E8AF8EA77777CE9C9F9D9", result["header_hash"])
+	assert.Equal(t, "FC9BAB94965F7C00A896AF484610B7869973E7D06E537274407F70359B353E7A", result["commit_hash"])
+	assert.NotContains(t, result, "data_hash")
+	assert.NotContains(t, result, "evidence_data_hash")
+
+	data = map[string]interface{}{"_msg": "Block{\n  ValidatorSet{\n    Proposer: abc\n  }\n}#DEADBEEF"}
+	result = expandFieldsIn(data, "_msg")
+	assert.Equal(t, "DEADBEEF", result["block_hash"])
+	assert.Equal(t, "abc", result["Proposer"])
+	assert.NotContains(t, result, "validator_set_hash")
+}
+
+// bufferingSender is a transmission.Sender which, like libhoney's real one,
+// holds events back until it's flushed or stopped.
+type bufferingSender struct {
+	transmission.MockSender
+	mu      sync.Mutex
+	pending []*transmission.Event
+	stopped chan struct{}
+}
+
+func newBufferingSender() *bufferingSender {
+	return &bufferingSender{stopped: make(chan struct{})}
+}
+
+func (b *bufferingSender) Add(ev *transmission.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.stopped:
+		// libhoney's own sender closes its channels when stopped
+		panic("send on closed channel")
+	default:
+	}
+	b.pending = append(b.pending, ev)
+}
+
+func (b *bufferingSender) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ev := range b.pending {
+		b.MockSender.Add(ev)
+	}
+	b.pending = nil
+	return nil
+}
+
+func (b *bufferingSender) Stop() error {
+	err := b.Flush()
+	b.mu.Lock()
+	close(b.stopped)
+	b.mu.Unlock()
+	return err
+}
+
+// initSender points libhoney at sender and reopens the package, so that each
+// test starts from a fresh, open client.
+func initSender(t *testing.T, sender transmission.Sender) {
+	err := libhoney.Init(libhoney.Config{
+		WriteKey:     "test",
+		Dataset:      "test",
+		Transmission: sender,
+	})
+	assert.NoError(t, err)
+	closeMu.Lock()
+	closed = false
+	closeMu.Unlock()
+}
+
+func TestCloseDelivers(t *testing.T) {
+	sender := newBufferingSender()
+	initSender(t, sender)
+	w := &honeycombWriter{}
+	hook := &HoneycombHook{}
+
+	for i := 0; i < 3; i++ {
+		_, err := w.Write([]byte(fmt.Sprintf(`{"n":%d}`, i)))
+		assert.NoError(t, err)
+	}
+	logger := logrus.New()
+	err := hook.Fire(logrus.NewEntry(logger).WithField("from", "hook"))
+	assert.NoError(t, err)
+	assert.Len(t, sender.Events(), 0)
+
+	assert.NoError(t, Close(context.Background()))
+	events := sender.Events()
+	assert.Len(t, events, 4)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, int64(i), events[i].Data["n"])
+	}
+	assert.Equal(t, "hook", events[3].Data["from"])
+
+	// nothing more reaches libhoney once it's closed
+	_, err = w.Write([]byte(`{"n":3}`))
+	assert.Equal(t, ErrClosed, err)
+	assert.NoError(t, hook.Fire(logrus.NewEntry(logger)))
+	hook.Flush()
+	assert.Len(t, sender.Events(), 4)
+	assert.NoError(t, Close(context.Background()))
+}
+
+func TestCloseExpiredContext(t *testing.T) {
+	sender := newBufferingSender()
+	initSender(t, sender)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, Close(ctx))
+	_, err := (&honeycombWriter{}).Write([]byte(`{"n":0}`))
+	assert.Equal(t, ErrClosed, err)
+	// libhoney is still shut down in the background; wait for that, so it
+	// can't race with later tests' use of the client
+	<-sender.stopped
+}
+
+func TestCloseWhileSending(t *testing.T) {
+	sender := newBufferingSender()
+	initSender(t, sender)
+	w := &honeycombWriter{}
+	hook := &HoneycombHook{}
+	logger := logrus.New()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				w.Write([]byte(`{"n":1}`))
+				hook.Fire(logrus.NewEntry(logger))
+				hook.Flush()
+			}
+		}()
+	}
+	assert.NoError(t, Close(context.Background()))
+	wg.Wait()
+	<-sender.stopped
+}
+
+func TestHookLevels(t *testing.T) {
+	defer func(has bool, min logrus.Level) {
+		hasMinLevel, minLevel = has, min
+	}(hasMinLevel, minLevel)
+	hook := &HoneycombHook{}
+
+	hasMinLevel = false
+	assert.Equal(t, hookLevels, hook.Levels())
+
+	hasMinLevel = true
+	minLevel = logrus.TraceLevel
+	assert.Equal(t, hookLevels, hook.Levels())
+	minLevel = logrus.InfoLevel
+	assert.Equal(t, hookLevels, hook.Levels())
+	minLevel = logrus.WarnLevel
+	assert.Equal(t, []logrus.Level{logrus.ErrorLevel, logrus.FatalLevel, logrus.PanicLevel}, hook.Levels())
+	minLevel = logrus.FatalLevel
+	assert.Equal(t, []logrus.Level{logrus.FatalLevel, logrus.PanicLevel}, hook.Levels())
+}